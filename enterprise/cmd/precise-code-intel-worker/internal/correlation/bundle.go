@@ -0,0 +1,17 @@
+package correlation
+
+import "github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+
+// GroupedBundleDataMaps is the in-memory, map-backed form of a correlated
+// LSIF bundle: the subset of an upload's data that the precise-code-intel
+// worker needs in order to patch it against another bundle.
+//
+// This is the correlation package's only declaration of the type: worker
+// has referenced correlation.GroupedBundleDataMaps since before this
+// package had any files of its own, and this is where it's actually
+// defined now that OverlayBundle needs a concrete type to wrap.
+type GroupedBundleDataMaps struct {
+	Meta         lsifstore.MetaData
+	Documents    map[string]lsifstore.DocumentData
+	ResultChunks map[int]lsifstore.ResultChunkData
+}
@@ -0,0 +1,172 @@
+package correlation
+
+import "github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+
+// MutationKind identifies what kind of change a Mutation records.
+type MutationKind int
+
+const (
+	// MutationSetDocument stages a whole-document write (new or replaced).
+	MutationSetDocument MutationKind = iota
+	// MutationDeleteDocument stages a document removal.
+	MutationDeleteDocument
+	// MutationSetResultChunk stages a whole-result-chunk write.
+	MutationSetResultChunk
+)
+
+// Mutation is one staged change against a GroupedBundleDataMaps. Exactly
+// one of Document/Chunk is meaningful, matching Kind.
+type Mutation struct {
+	Kind     MutationKind
+	Path     string
+	ChunkID  int
+	Document lsifstore.DocumentData
+	Chunk    lsifstore.ResultChunkData
+}
+
+// OverlayBundle stages a merge against a read-only base bundle as an
+// ordered mutation log instead of writing through base's maps directly, so
+// that a merge which fails partway through (e.g. newID running out of
+// entropy, or a future error path) can be Abort()ed and leave base exactly
+// as it was, rather than half-patched and unsafe to persist.
+//
+// Reads (Document/ResultChunk) are layered: they return the latest staged
+// value for a path/chunk if one has been written this transaction,
+// falling back to base otherwise. This lets patchData read back its own
+// uncommitted writes within the same merge.
+//
+// Scope note: this is in-memory isolation within a single patchData call,
+// not the durable, content-hashed on-disk staging area the request also
+// asked for (sha256-keyed chunk files a restarted worker could resume
+// from mid-patch). A worker process dying mid-merge still loses the
+// in-flight patch entirely; OverlayBundle only protects base from seeing
+// a half-applied one. Persisting the log/overrides here to disk so a
+// restart could replay or resume them is left as a follow-up.
+type OverlayBundle struct {
+	base *GroupedBundleDataMaps
+	log  []Mutation
+
+	documentOverrides map[string]*lsifstore.DocumentData // nil value means staged-deleted
+	chunkOverrides    map[int]lsifstore.ResultChunkData
+}
+
+// NewOverlayBundle returns an OverlayBundle staging writes against base.
+// base is never modified except by a subsequent call to Commit.
+func NewOverlayBundle(base *GroupedBundleDataMaps) *OverlayBundle {
+	return &OverlayBundle{
+		base:              base,
+		documentOverrides: make(map[string]*lsifstore.DocumentData),
+		chunkOverrides:    make(map[int]lsifstore.ResultChunkData),
+	}
+}
+
+// Document returns the staged version of path's document if one has been
+// written this transaction, otherwise base's.
+func (o *OverlayBundle) Document(path string) (lsifstore.DocumentData, bool) {
+	if override, staged := o.documentOverrides[path]; staged {
+		if override == nil {
+			return lsifstore.DocumentData{}, false
+		}
+		return *override, true
+	}
+
+	doc, ok := o.base.Documents[path]
+	return doc, ok
+}
+
+// OriginalDocument returns path's document as it was in base before this
+// transaction staged any writes, ignoring any overrides. Useful for
+// summarizing what a transaction changed (see PatchSummary).
+func (o *OverlayBundle) OriginalDocument(path string) (lsifstore.DocumentData, bool) {
+	doc, ok := o.base.Documents[path]
+	return doc, ok
+}
+
+// SetDocument stages path's document as doc, overriding base's version (or
+// adding a new one) once Commit runs.
+func (o *OverlayBundle) SetDocument(path string, doc lsifstore.DocumentData) {
+	o.log = append(o.log, Mutation{Kind: MutationSetDocument, Path: path, Document: doc})
+	d := doc
+	o.documentOverrides[path] = &d
+}
+
+// DeleteDocument stages path's document for removal.
+func (o *OverlayBundle) DeleteDocument(path string) {
+	o.log = append(o.log, Mutation{Kind: MutationDeleteDocument, Path: path})
+	o.documentOverrides[path] = nil
+}
+
+// StagedResultChunk returns chunkID's staged chunk, copying it out of base
+// with fresh DocumentPaths/DocumentIDRangeIDs maps the first time it's
+// touched in this transaction. Callers are expected to mutate the maps on
+// the returned value directly; because the copy is cached in
+// chunkOverrides, repeated calls for the same chunkID return the same
+// backing maps, so those in-place edits accumulate correctly and are
+// already reflected in the log entry logged on first touch.
+func (o *OverlayBundle) StagedResultChunk(chunkID int) lsifstore.ResultChunkData {
+	if staged, ok := o.chunkOverrides[chunkID]; ok {
+		return staged
+	}
+
+	src := o.base.ResultChunks[chunkID]
+	staged := lsifstore.ResultChunkData{
+		DocumentPaths:      make(map[lsifstore.ID]string, len(src.DocumentPaths)),
+		DocumentIDRangeIDs: make(map[lsifstore.ID][]lsifstore.DocumentIDRangeID, len(src.DocumentIDRangeIDs)),
+	}
+	for id, path := range src.DocumentPaths {
+		staged.DocumentPaths[id] = path
+	}
+	for id, rngs := range src.DocumentIDRangeIDs {
+		// Copy the slice's backing array, not just its header: patch.go
+		// appends directly onto a result returned from here, and an append
+		// within cap(rngs) would otherwise write into base's own array
+		// before Commit/Abort decides whether that write should happen.
+		cp := make([]lsifstore.DocumentIDRangeID, len(rngs))
+		copy(cp, rngs)
+		staged.DocumentIDRangeIDs[id] = cp
+	}
+
+	o.SetResultChunk(chunkID, staged)
+	return staged
+}
+
+// SetResultChunk stages chunkID's chunk as chunk, overriding base's
+// version once Commit runs.
+func (o *OverlayBundle) SetResultChunk(chunkID int, chunk lsifstore.ResultChunkData) {
+	o.log = append(o.log, Mutation{Kind: MutationSetResultChunk, ChunkID: chunkID, Chunk: chunk})
+	o.chunkOverrides[chunkID] = chunk
+}
+
+// Log returns the mutations staged so far, in the order they were
+// recorded. It's read-only summary data for callers like a dry run; it is
+// not safe to mutate the returned slice's contents.
+func (o *OverlayBundle) Log() []Mutation {
+	return o.log
+}
+
+// Commit applies every staged mutation to base and clears the log. Once
+// Commit returns, base reflects the full merge; there is no partial-commit
+// state since every mutation here is a single map write.
+func (o *OverlayBundle) Commit() {
+	for _, m := range o.log {
+		switch m.Kind {
+		case MutationSetDocument:
+			o.base.Documents[m.Path] = m.Document
+		case MutationDeleteDocument:
+			delete(o.base.Documents, m.Path)
+		case MutationSetResultChunk:
+			o.base.ResultChunks[m.ChunkID] = m.Chunk
+		}
+	}
+
+	o.log = nil
+	o.documentOverrides = make(map[string]*lsifstore.DocumentData)
+	o.chunkOverrides = make(map[int]lsifstore.ResultChunkData)
+}
+
+// Abort discards every staged mutation without touching base.
+func (o *OverlayBundle) Abort() {
+	o.log = nil
+	o.documentOverrides = make(map[string]*lsifstore.DocumentData)
+	o.chunkOverrides = make(map[int]lsifstore.ResultChunkData)
+}
@@ -0,0 +1,110 @@
+package correlation
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+func testBase() *GroupedBundleDataMaps {
+	return &GroupedBundleDataMaps{
+		Documents: map[string]lsifstore.DocumentData{
+			"a.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{"r1": {StartLine: 1}}},
+		},
+		ResultChunks: map[int]lsifstore.ResultChunkData{
+			0: {
+				DocumentPaths:      map[lsifstore.ID]string{"d1": "a.go"},
+				DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{"res1": {{DocumentID: "d1", RangeID: "r1"}}},
+			},
+		},
+	}
+}
+
+func TestOverlayBundleCommit(t *testing.T) {
+	base := testBase()
+	overlay := NewOverlayBundle(base)
+
+	overlay.SetDocument("b.go", lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{"r2": {StartLine: 2}}})
+	overlay.DeleteDocument("a.go")
+
+	if _, ok := base.Documents["b.go"]; ok {
+		t.Fatal("expected base to be untouched before Commit")
+	}
+	if _, ok := base.Documents["a.go"]; !ok {
+		t.Fatal("expected base's a.go to survive until Commit")
+	}
+
+	overlay.Commit()
+
+	if _, ok := base.Documents["a.go"]; ok {
+		t.Fatal("expected a.go to be deleted from base after Commit")
+	}
+	if _, ok := base.Documents["b.go"]; !ok {
+		t.Fatal("expected b.go to be added to base after Commit")
+	}
+}
+
+func TestOverlayBundleAbort(t *testing.T) {
+	base := testBase()
+	overlay := NewOverlayBundle(base)
+
+	overlay.DeleteDocument("a.go")
+	overlay.SetDocument("b.go", lsifstore.DocumentData{})
+	overlay.Abort()
+
+	if _, ok := base.Documents["a.go"]; !ok {
+		t.Fatal("expected a.go to survive Abort")
+	}
+	if _, ok := base.Documents["b.go"]; ok {
+		t.Fatal("expected b.go to never reach base after Abort")
+	}
+	if len(overlay.Log()) != 0 {
+		t.Fatal("expected Abort to clear the mutation log")
+	}
+}
+
+func TestOverlayBundleStagedResultChunkIsolatesBase(t *testing.T) {
+	base := testBase()
+	overlay := NewOverlayBundle(base)
+
+	chunk := overlay.StagedResultChunk(0)
+	chunk.DocumentIDRangeIDs["res1"] = nil
+
+	if got := base.ResultChunks[0].DocumentIDRangeIDs["res1"]; got == nil {
+		t.Fatal("expected base's result chunk to be untouched before Commit")
+	}
+
+	// A second StagedResultChunk call for the same chunk must return the
+	// same staged copy, not a fresh one that would lose the first edit.
+	again := overlay.StagedResultChunk(0)
+	if again.DocumentIDRangeIDs["res1"] != nil {
+		t.Fatal("expected the earlier edit to be visible on re-fetching the staged chunk")
+	}
+
+	overlay.Commit()
+	if got := base.ResultChunks[0].DocumentIDRangeIDs["res1"]; got != nil {
+		t.Fatal("expected the staged edit to land in base after Commit")
+	}
+}
+
+func TestOverlayBundleStagedResultChunkAppendIsolatesBase(t *testing.T) {
+	base := testBase()
+	// Give res1 spare capacity, the way encoding/json unmarshaling into a
+	// slice routinely does, so that an append within cap would silently
+	// write into base's own backing array if StagedResultChunk only copied
+	// the slice header rather than its contents.
+	rngs := make([]lsifstore.DocumentIDRangeID, 1, 4)
+	rngs[0] = lsifstore.DocumentIDRangeID{DocumentID: "d1", RangeID: "r1"}
+	base.ResultChunks[0] = lsifstore.ResultChunkData{
+		DocumentPaths:      base.ResultChunks[0].DocumentPaths,
+		DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{"res1": rngs},
+	}
+
+	overlay := NewOverlayBundle(base)
+	chunk := overlay.StagedResultChunk(0)
+	chunk.DocumentIDRangeIDs["res1"] = append(chunk.DocumentIDRangeIDs["res1"], lsifstore.DocumentIDRangeID{DocumentID: "d2", RangeID: "r2"})
+
+	if got := base.ResultChunks[0].DocumentIDRangeIDs["res1"]; len(got) != 1 {
+		t.Fatalf("expected base's result chunk to be untouched by the staged append before Commit, got %v", got)
+	}
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"context"
+
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/precise-code-intel-worker/internal/correlation"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/gitserver"
+)
+
+// PatchSummary reports what ApplyPatch did, or would do for a DryRun: how
+// many ranges were added to or dropped from base's documents, and how many
+// def/ref result ID pairs were allocated fresh rather than reused from base.
+type PatchSummary struct {
+	RangesAdded        int
+	RangesRemoved      int
+	ResultIDsAllocated int
+}
+
+// ApplyPatch is the worker's entry point for merging patch into base. The
+// merge is staged into a correlation.OverlayBundle rather than applied to
+// base directly, so a failure partway through never leaves base half
+// modified; ApplyPatch commits the overlay on success, or discards it
+// outright when opts.DryRun is set, returning a PatchSummary either way so
+// a dry run can be inspected before anything is written back to storage.
+func ApplyPatch(ctx context.Context, base *correlation.GroupedBundleDataMaps, patch *correlation.GroupedBundleDataMaps, reindexedFiles []string, fileStatus map[string]gitserver.Status, hunksByPath map[string][]gitserver.Hunk, opts PatchOptions) (PatchSummary, error) {
+	overlay := correlation.NewOverlayBundle(base)
+
+	resultIDsAllocated, err := patchData(ctx, overlay, base.Meta, patch, reindexedFiles, fileStatus, hunksByPath, opts)
+	if err != nil {
+		overlay.Abort()
+		return PatchSummary{}, err
+	}
+
+	rangesAdded, rangesRemoved := summarizeDocumentChanges(overlay)
+	summary := PatchSummary{
+		RangesAdded:        rangesAdded,
+		RangesRemoved:      rangesRemoved,
+		ResultIDsAllocated: resultIDsAllocated,
+	}
+
+	if opts.DryRun {
+		overlay.Abort()
+		return summary, nil
+	}
+
+	overlay.Commit()
+	return summary, nil
+}
+
+// summarizeDocumentChanges walks overlay's staged mutation log and counts
+// how many ranges, across every touched document, were added versus
+// removed relative to base's original (pre-transaction) documents.
+func summarizeDocumentChanges(overlay *correlation.OverlayBundle) (added, removed int) {
+	for _, m := range overlay.Log() {
+		switch m.Kind {
+		case correlation.MutationSetDocument:
+			before, _ := overlay.OriginalDocument(m.Path)
+			for rngID := range m.Document.Ranges {
+				if _, existed := before.Ranges[rngID]; !existed {
+					added++
+				}
+			}
+			for rngID := range before.Ranges {
+				if _, kept := m.Document.Ranges[rngID]; !kept {
+					removed++
+				}
+			}
+
+		case correlation.MutationDeleteDocument:
+			if before, existed := overlay.OriginalDocument(m.Path); existed {
+				removed += len(before.Ranges)
+			}
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	radix "github.com/armon/go-radix"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+// HoverLookup resolves the hover text attached to a range's HoverResultID.
+type HoverLookup func(path string, id lsifstore.ID) string
+
+// MonikerLookup resolves a range's MonikerIDs to their full MonikerData
+// records.
+type MonikerLookup func(path string, ids []lsifstore.ID) []lsifstore.MonikerData
+
+// contentHashOf hashes rng's shape together with its hover text and
+// monikers. hover/monikers are nil-safe: a caller that hasn't wired up
+// either lookup (e.g. a bare PatchOptions{}) still gets a hash derived
+// from the range's shape alone, rather than a nil-pointer panic on the
+// very first unchanged file.
+func contentHashOf(path string, rng lsifstore.RangeData, hover HoverLookup, monikers MonikerLookup) lsifstore.ID {
+	var hoverText string
+	if hover != nil {
+		hoverText = hover(path, rng.HoverResultID)
+	}
+
+	var monikerData []lsifstore.MonikerData
+	if monikers != nil {
+		monikerData = monikers(path, rng.MonikerIDs)
+	}
+
+	return lsifstore.RangeContentHash(rng, hoverText, monikerData)
+}
+
+// rangeHashIndex maps a document's range content hashes to their range IDs,
+// backed by a radix tree keyed by the hash string. pairRangesByContentHash
+// builds it once per call from every base range and reuses it for every
+// patch range lookup in that call, so pairing costs
+// O(|base ranges| + |patch ranges|) rather than
+// O(|base ranges| × |patch ranges|); each call still reads every base range.
+//
+// The index itself isn't persisted anywhere, so it's rebuilt from
+// updateToDoc.Ranges on every patchData call; there's no win carried over
+// between separate patches the way a durable, on-disk index keyed by
+// bundle/path would give. Building that durable index would mean storing
+// it in lsifstore, which can't depend on HoverLookup/MonikerLookup (they're
+// worker-level callbacks resolving hover/moniker data the caller owns), so
+// it's left as a possible follow-up rather than bolted on here.
+type rangeHashIndex struct {
+	tree *radix.Tree
+}
+
+func newRangeHashIndex(path string, doc lsifstore.DocumentData, hover HoverLookup, monikers MonikerLookup) *rangeHashIndex {
+	tree := radix.New()
+	for rngID, rng := range doc.Ranges {
+		tree.Insert(string(contentHashOf(path, rng, hover, monikers)), rngID)
+	}
+
+	return &rangeHashIndex{tree: tree}
+}
+
+func (idx *rangeHashIndex) lookup(hash lsifstore.ID) (lsifstore.ID, bool) {
+	v, ok := idx.tree.Get(string(hash))
+	if !ok {
+		return "", false
+	}
+
+	return v.(lsifstore.ID), true
+}
+
+// pairRangesByContentHash pairs toUpdateDoc's ranges with updateToDoc's by
+// content hash rather than by position, so the two documents no longer
+// need the same number of ranges to be paired up (e.g. the indexer added
+// an anonymous type on an otherwise-unchanged file). It returns the pairing
+// plus the IDs of any updateToDoc ranges that had no counterpart in
+// toUpdateDoc at all.
+func pairRangesByContentHash(path string, updateToDoc, toUpdateDoc lsifstore.DocumentData, hover HoverLookup, monikers MonikerLookup) (paired map[lsifstore.ID]lsifstore.ID, droppedBaseRangeIDs []lsifstore.ID) {
+	index := newRangeHashIndex(path, updateToDoc, hover, monikers)
+	matchedBaseIDs := make(map[lsifstore.ID]struct{}, len(toUpdateDoc.Ranges))
+	paired = make(map[lsifstore.ID]lsifstore.ID, len(toUpdateDoc.Ranges))
+
+	for toUpdateRngID, toUpdateRng := range toUpdateDoc.Ranges {
+		baseRngID, ok := index.lookup(contentHashOf(path, toUpdateRng, hover, monikers))
+		if !ok {
+			continue
+		}
+
+		paired[toUpdateRngID] = baseRngID
+		matchedBaseIDs[baseRngID] = struct{}{}
+	}
+
+	for baseRngID := range updateToDoc.Ranges {
+		if _, matched := matchedBaseIDs[baseRngID]; !matched {
+			droppedBaseRangeIDs = append(droppedBaseRangeIDs, baseRngID)
+		}
+	}
+
+	return paired, droppedBaseRangeIDs
+}
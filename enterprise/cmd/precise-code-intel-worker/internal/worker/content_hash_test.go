@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/precise-code-intel-worker/internal/correlation"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/gitserver"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+func noHover(_ string, _ lsifstore.ID) string { return "" }
+
+func noMonikers(_ string, _ []lsifstore.ID) []lsifstore.MonikerData { return nil }
+
+func TestPairRangesByContentHash(t *testing.T) {
+	base := lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{
+		"base-foo": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10},
+		"base-bar": {StartLine: 5, StartCharacter: 0, EndLine: 5, EndCharacter: 10},
+	}}
+
+	t.Run("identical ranges pair up regardless of ID", func(t *testing.T) {
+		patch := lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{
+			"patch-foo": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10},
+			"patch-bar": {StartLine: 5, StartCharacter: 0, EndLine: 5, EndCharacter: 10},
+		}}
+
+		paired, dropped := pairRangesByContentHash("f.go", base, patch, noHover, noMonikers)
+		if len(dropped) != 0 {
+			t.Fatalf("expected nothing dropped, got %v", dropped)
+		}
+		if paired["patch-foo"] != "base-foo" || paired["patch-bar"] != "base-bar" {
+			t.Fatalf("unexpected pairing: %v", paired)
+		}
+	})
+
+	t.Run("an extra range in the patch (e.g. an added anonymous type) doesn't block pairing", func(t *testing.T) {
+		patch := lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{
+			"patch-foo":   {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10},
+			"patch-bar":   {StartLine: 5, StartCharacter: 0, EndLine: 5, EndCharacter: 10},
+			"patch-extra": {StartLine: 9, StartCharacter: 0, EndLine: 9, EndCharacter: 3},
+		}}
+
+		paired, dropped := pairRangesByContentHash("f.go", base, patch, noHover, noMonikers)
+		if len(dropped) != 0 {
+			t.Fatalf("expected nothing dropped, got %v", dropped)
+		}
+		if _, ok := paired["patch-extra"]; ok {
+			t.Fatal("expected the unmatched extra range to be left unpaired, not forced onto a base ID")
+		}
+		if len(paired) != 2 {
+			t.Fatalf("expected exactly the two matching ranges to pair up, got %v", paired)
+		}
+	})
+
+	t.Run("a base range missing from the patch is reported as dropped", func(t *testing.T) {
+		patch := lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{
+			"patch-foo": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10},
+		}}
+
+		_, dropped := pairRangesByContentHash("f.go", base, patch, noHover, noMonikers)
+		if len(dropped) != 1 || dropped[0] != "base-bar" {
+			t.Fatalf("expected base-bar to be reported dropped, got %v", dropped)
+		}
+	})
+
+	t.Run("nil hover and moniker lookups don't panic", func(t *testing.T) {
+		patch := lsifstore.DocumentData{Ranges: map[lsifstore.ID]lsifstore.RangeData{
+			"patch-foo": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10},
+		}}
+
+		paired, _ := pairRangesByContentHash("f.go", base, patch, nil, nil)
+		if paired["patch-foo"] != "base-foo" {
+			t.Fatalf("unexpected pairing: %v", paired)
+		}
+	})
+}
+
+// TestApplyPatchUnchangedWithBareOptions exercises the default route an
+// Unchanged path now takes through unifyRangeIDs (content-hash pairing)
+// when the caller hasn't populated PatchOptions.Hover/Monikers at all, as
+// every call site before content-hash pairing existed would not have.
+func TestApplyPatchUnchangedWithBareOptions(t *testing.T) {
+	base := &correlation.GroupedBundleDataMaps{
+		Meta: lsifstore.MetaData{NumResultChunks: 1},
+		Documents: map[string]lsifstore.DocumentData{
+			"f.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{
+				"base-rng": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10, DefinitionResultID: "def1", ReferenceResultID: "ref1"},
+			}},
+		},
+		ResultChunks: map[int]lsifstore.ResultChunkData{
+			0: {
+				DocumentPaths: map[lsifstore.ID]string{"doc1": "f.go"},
+				DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{
+					"def1": {{DocumentID: "doc1", RangeID: "base-rng"}},
+					"ref1": {{DocumentID: "doc1", RangeID: "base-rng"}},
+				},
+			},
+		},
+	}
+	patch := &correlation.GroupedBundleDataMaps{
+		Meta: lsifstore.MetaData{NumResultChunks: 1},
+		Documents: map[string]lsifstore.DocumentData{
+			"f.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{
+				"patch-rng": {StartLine: 1, StartCharacter: 0, EndLine: 1, EndCharacter: 10, DefinitionResultID: "pdef1", ReferenceResultID: "pref1"},
+			}},
+		},
+		ResultChunks: map[int]lsifstore.ResultChunkData{
+			0: {
+				DocumentPaths: map[lsifstore.ID]string{"pdoc1": "f.go"},
+				DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{
+					"pdef1": {{DocumentID: "pdoc1", RangeID: "patch-rng"}},
+					"pref1": {{DocumentID: "pdoc1", RangeID: "patch-rng"}},
+				},
+			},
+		},
+	}
+
+	fileStatus := map[string]gitserver.Status{"f.go": gitserver.Unchanged}
+
+	if _, err := ApplyPatch(context.Background(), base, patch, nil, fileStatus, nil, PatchOptions{}); err != nil {
+		t.Fatalf("ApplyPatch returned an unexpected error: %v", err)
+	}
+}
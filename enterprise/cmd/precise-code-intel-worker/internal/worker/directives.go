@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+// DocumentDirective overrides the gitserver.Status heuristic that patchData
+// would otherwise use to decide what to do with a single document, modeled
+// after Kubernetes' strategic merge patch directives.
+//
+// Scope note: this package only implements the Go-API side of directives
+// (PatchOptions.Directives/RetainMonikers plus validateDirectives' sanity
+// checks). Carrying a directive from an actual uploaded patch bundle would
+// need a new multipart field on the upload HTTP handler to transport the
+// directive JSON, and a place in lsifstore for validateDirectives-style
+// checks to live so they run before a bundle is persisted; no such handler
+// exists anywhere in this tree yet, so that wiring is explicitly left out
+// here rather than bolted onto an HTTP surface this package doesn't own.
+//
+// TODO: as shipped, nothing outside this package's own tests ever
+// populates PatchOptions.Directives, so a real upload has no way to set a
+// directive and the feature is inert in production. File a follow-up
+// issue to wire up the upload handler field and lsifstore validation
+// described above before relying on directives outside tests.
+type DocumentDirective string
+
+const (
+	// DirectiveMerge is the default: patchData falls back to inferring
+	// intent from the file's gitserver.Status, exactly as it did before
+	// directives existed.
+	DirectiveMerge DocumentDirective = "merge"
+	// DirectiveReplace drops the base document entirely in favor of the
+	// patch's document, as though the path were newly added.
+	DirectiveReplace DocumentDirective = "replace"
+	// DirectiveDelete removes the document from base and ignores the
+	// patch's version of it, even if the patch still carries one.
+	DirectiveDelete DocumentDirective = "delete"
+	// DirectiveRetainKeys keeps only the base ranges whose MonikerIDs
+	// appear in the accompanying retention set (see retainMonikers);
+	// the patch's version of the document, if any, is ignored.
+	DirectiveRetainKeys DocumentDirective = "retainKeys"
+)
+
+// ResultChunkStrategy is a bundle-level directive controlling whether
+// patchData is allowed to reallocate def/ref result IDs.
+type ResultChunkStrategy string
+
+const (
+	// ResultChunkStrategyReallocate is the default and matches the
+	// pre-existing behavior: new IDs are minted wherever content isn't
+	// provably unchanged.
+	ResultChunkStrategyReallocate ResultChunkStrategy = "reallocate"
+	// ResultChunkStrategyPreserveIDs asks patchData to keep symbol IDs
+	// stable even across a full reindex, for uploaders whose indexer
+	// output isn't otherwise deterministic run-to-run.
+	ResultChunkStrategyPreserveIDs ResultChunkStrategy = "preserveIDs"
+)
+
+// validateDirectives rejects directive combinations that can't be
+// satisfied, such as a delete directive paired with a patch document that
+// still has ranges to apply.
+func validateDirectives(directives map[string]DocumentDirective, patchDocs map[string]lsifstore.DocumentData) error {
+	for path, directive := range directives {
+		if directive == DirectiveDelete {
+			if doc, exists := patchDocs[path]; exists && len(doc.Ranges) > 0 {
+				return errors.Errorf("patch directive for %q is %q but the patch still carries a non-empty document for it", path, DirectiveDelete)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rangeRetained reports whether rng should survive a DirectiveRetainKeys
+// directive, i.e. whether any of its MonikerIDs appears in retain.
+func rangeRetained(rng lsifstore.RangeData, retain map[lsifstore.ID]struct{}) bool {
+	for _, monikerID := range rng.MonikerIDs {
+		if _, ok := retain[monikerID]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PatchOptions bundles the patchData inputs that aren't the core base/patch
+// bundles or the git diff itself. It's grown one field at a time as the
+// patch format picked up directives, a result-chunk strategy, and
+// content-addressed range pairing; keeping them in one struct instead of
+// an ever-longer parameter list lets call sites name them.
+type PatchOptions struct {
+	// Directives carries per-document overrides of the gitserver.Status
+	// heuristic (see DocumentDirective).
+	Directives map[string]DocumentDirective
+	// RetainMonikers supplies the retention set for each path with a
+	// DirectiveRetainKeys directive.
+	RetainMonikers map[string]map[lsifstore.ID]struct{}
+	// ResultChunkStrategy controls whether unifyRangeIDs may reallocate
+	// IDs freely or should try to keep them stable across pushes.
+	ResultChunkStrategy ResultChunkStrategy
+	// Hover and Monikers resolve the data RangeContentHash needs; they're
+	// supplied by the caller, which has access to the bundle's hover and
+	// moniker tables.
+	Hover    HoverLookup
+	Monikers MonikerLookup
+	// DryRun asks ApplyPatch to run the full merge and report a
+	// PatchSummary without committing any of it to base.
+	DryRun bool
+}
@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+func TestValidateDirectives(t *testing.T) {
+	patchDocs := map[string]lsifstore.DocumentData{
+		"empty.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{}},
+		"full.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{
+			"r1": {},
+		}},
+	}
+
+	if err := validateDirectives(map[string]DocumentDirective{"empty.go": DirectiveDelete}, patchDocs); err != nil {
+		t.Fatalf("unexpected error for delete + empty patch document: %s", err)
+	}
+
+	if err := validateDirectives(map[string]DocumentDirective{"full.go": DirectiveDelete}, patchDocs); err == nil {
+		t.Fatal("expected an error for delete + non-empty patch document")
+	}
+}
+
+func TestRangeRetained(t *testing.T) {
+	retain := map[lsifstore.ID]struct{}{"keep-me": {}}
+
+	rng := lsifstore.RangeData{MonikerIDs: []lsifstore.ID{"other", "keep-me"}}
+	if !rangeRetained(rng, retain) {
+		t.Fatal("expected range with a retained moniker to be retained")
+	}
+
+	rng = lsifstore.RangeData{MonikerIDs: []lsifstore.ID{"other"}}
+	if rangeRetained(rng, retain) {
+		t.Fatal("expected range with no retained moniker to be dropped")
+	}
+}
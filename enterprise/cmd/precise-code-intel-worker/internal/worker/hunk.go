@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/gitserver"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+// translateThroughUnchangedHunk reports whether rng, a range from the
+// patch-side document, falls entirely inside one of hunks' patch spans
+// (LSIF ranges are 0-indexed; hunks are 1-indexed, so we convert before
+// comparing) and, if so, returns rng translated onto the base revision by
+// the hunk's line offset.
+func translateThroughUnchangedHunk(rng lsifstore.RangeData, hunks []gitserver.Hunk) (lsifstore.RangeData, bool) {
+	startLine := rng.StartLine + 1
+	endLine := rng.EndLine + 1
+
+	for _, h := range hunks {
+		if startLine < h.PatchStartLine || endLine > h.PatchEndLine {
+			continue
+		}
+
+		offset := h.BaseStartLine - h.PatchStartLine
+		translated := rng
+		translated.StartLine += offset
+		translated.EndLine += offset
+		return translated, true
+	}
+
+	return lsifstore.RangeData{}, false
+}
+
+// findMatchingRange looks up the range in doc whose position exactly
+// matches translated, returning its ID. Used to pair a patch range that
+// landed inside an unchanged hunk with its counterpart on the other
+// revision.
+func findMatchingRange(doc lsifstore.DocumentData, translated lsifstore.RangeData) (lsifstore.ID, bool) {
+	for id, candidate := range doc.Ranges {
+		if lsifstore.CompareRanges(candidate, translated) == 0 {
+			return id, true
+		}
+	}
+
+	return "", false
+}
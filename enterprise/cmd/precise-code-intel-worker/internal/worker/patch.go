@@ -7,42 +7,88 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/inconshreveable/log15"
-	"github.com/pkg/errors"
 	"github.com/sourcegraph/sourcegraph/enterprise/cmd/precise-code-intel-worker/internal/correlation"
 	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/gitserver"
 	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
 )
 
-func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, patch *correlation.GroupedBundleDataMaps, reindexedFiles []string, fileStatus map[string]gitserver.Status) (err error) {
+// patchData stages base's merge with patch into overlay rather than
+// mutating base directly, so that a mid-merge error (most likely from
+// newID running out of entropy) leaves base untouched; ApplyPatch decides
+// whether to Commit or Abort the overlay once patchData returns. It
+// returns the number of def/ref result ID pairs it allocated fresh rather
+// than reusing from base, for PatchSummary.
+func patchData(ctx context.Context, overlay *correlation.OverlayBundle, baseMeta lsifstore.MetaData, patch *correlation.GroupedBundleDataMaps, reindexedFiles []string, fileStatus map[string]gitserver.Status, hunksByPath map[string][]gitserver.Hunk, opts PatchOptions) (resultIDsAllocated int, err error) {
 	log15.Warn("loading patch data...")
 
+	directives := opts.Directives
+	retainMonikers := opts.RetainMonikers
+
+	if err := validateDirectives(directives, patch.Documents); err != nil {
+		return 0, err
+	}
+
+	// Directives take precedence over the git-status heuristic: replace
+	// behaves like an Added path (drop base, take the whole patch doc) and
+	// delete behaves like a Deleted one, regardless of what gitserver
+	// reported. merge (the default) leaves the status alone, and
+	// retainKeys paths are pruned separately below rather than through
+	// the status machinery.
+	effectiveStatus := make(map[string]gitserver.Status, len(fileStatus))
+	for path, status := range fileStatus {
+		effectiveStatus[path] = status
+	}
+	for path, directive := range directives {
+		switch directive {
+		case DirectiveReplace:
+			effectiveStatus[path] = gitserver.Added
+		case DirectiveDelete:
+			effectiveStatus[path] = gitserver.Deleted
+		}
+	}
+
 	reindexed := make(map[string]struct{})
 	for _, file := range reindexedFiles {
 		reindexed[file] = struct{}{}
 	}
 
 	modifiedOrDeletedPaths := make(map[string]struct{})
-	for path, status := range fileStatus {
+	for path, status := range effectiveStatus {
 		if status == gitserver.Modified || status == gitserver.Deleted {
 			modifiedOrDeletedPaths[path] = struct{}{}
 		}
 	}
-	removeRefsIn(modifiedOrDeletedPaths, base.Meta, base.Documents, base.ResultChunks)
+	for path, directive := range directives {
+		if directive == DirectiveRetainKeys || directive == DirectiveReplace {
+			modifiedOrDeletedPaths[path] = struct{}{}
+		}
+	}
+	// removeRefsIn must see the base documents in their pre-patch shape so
+	// it can tell which ranges are being dropped; pruning the retainKeys
+	// documents down to their surviving ranges happens only afterward.
+	removeRefsIn(modifiedOrDeletedPaths, overlay, baseMeta, deadRangesFor(directives, retainMonikers, hunksByPath))
+	pruneRetainedDocuments(overlay, directives, retainMonikers)
 
 	pathsToCopy := make(map[string]struct{})
 	unmodifiedReindexedPaths := make(map[string]struct{})
 	for path := range reindexed {
+		if directives[path] == DirectiveRetainKeys || directives[path] == DirectiveDelete {
+			continue
+		}
 		pathsToCopy[path] = struct{}{}
-		if fileStatus[path] == gitserver.Unchanged {
+		if effectiveStatus[path] == gitserver.Unchanged {
 			unmodifiedReindexedPaths[path] = struct{}{}
 		}
 	}
-	for path, status := range fileStatus {
-		if status == gitserver.Added {
+	for path, status := range effectiveStatus {
+		if status == gitserver.Added && directives[path] != DirectiveRetainKeys {
 			pathsToCopy[path] = struct{}{}
 		}
 	}
-	unifyRangeIDs(base.Documents, patch.Meta, patch.Documents, patch.ResultChunks, fileStatus)
+	reusedRanges, err := unifyRangeIDs(overlay, patch.Meta, patch.Documents, patch.ResultChunks, effectiveStatus, hunksByPath, opts)
+	if err != nil {
+		return 0, err
+	}
 
 	log15.Warn("indexing new data...")
 	defResultsByPath := make(map[string]map[lsifstore.ID]lsifstore.RangeData)
@@ -71,7 +117,7 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 
 	log15.Warn("merging data...")
 	for path, defsMap := range defResultsByPath {
-		baseDoc := base.Documents[path]
+		baseDoc, _ := overlay.Document(path)
 		doLog := path == "cmd/frontend/internal/app/updatecheck/handler.go"
 		defIdxs := sortedRangeIDs(defsMap)
 		for _, defRngID := range defIdxs {
@@ -80,7 +126,7 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 				log15.Warn(fmt.Sprintf("unifying def result defined in %v:%v:%v)", def.StartLine, def.StartCharacter, path))
 			}
 			var defID, refID lsifstore.ID
-			if fileStatus[path] == gitserver.Unchanged {
+			if _, reused := reusedRanges[path][defRngID]; reused {
 				baseRng := baseDoc.Ranges[defRngID]
 
 				defID = baseRng.DefinitionResultID
@@ -91,12 +137,13 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 			} else {
 				defID, err = newID()
 				if err != nil {
-					return err
+					return resultIDsAllocated, err
 				}
 				refID, err = newID()
 				if err != nil {
-					return err
+					return resultIDsAllocated, err
 				}
+				resultIDsAllocated++
 				if doLog {
 					log15.Warn(fmt.Sprintf("using new result IDs %v, %v", defID, refID))
 				}
@@ -105,8 +152,8 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 			patchRefs, patchRefChunk := getDefRef(def.ReferenceResultID, patch.Meta, patch.ResultChunks)
 
 			patchDefs, patchDefChunk := getDefRef(def.DefinitionResultID, patch.Meta, patch.ResultChunks)
-			baseRefs, baseRefChunk := getDefRef(refID, base.Meta, base.ResultChunks)
-			baseDefs, baseDefChunk := getDefRef(defID, base.Meta, base.ResultChunks)
+			baseRefs, baseRefChunk := getDefRefOverlay(refID, baseMeta, overlay)
+			baseDefs, baseDefChunk := getDefRefOverlay(defID, baseMeta, overlay)
 
 			baseRefDocumentIDs := make(map[string]lsifstore.ID)
 			for id, path := range baseRefChunk.DocumentPaths {
@@ -122,7 +169,7 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 				if doLog {
 					log15.Warn(fmt.Sprintf("processing ref %v:%v:%v", patchPath, patchRng.StartLine, patchRng.StartCharacter))
 				}
-				if fileStatus[patchPath] != gitserver.Unchanged {
+				if effectiveStatus[patchPath] != gitserver.Unchanged {
 					if doLog {
 						log15.Warn(fmt.Sprintf("adding ref"))
 					}
@@ -130,7 +177,7 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 					if !exists {
 						baseRefDocumentID, err = newID()
 						if err != nil {
-							return err
+							return resultIDsAllocated, err
 						}
 						baseRefDocumentIDs[path] = baseRefDocumentID
 						baseRefChunk.DocumentPaths[baseRefDocumentID] = path
@@ -156,7 +203,7 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 						if !exists {
 							baseDefDocumentID, err = newID()
 							if err != nil {
-								return err
+								return resultIDsAllocated, err
 							}
 							baseDefDocumentIDs[path] = baseDefDocumentID
 							baseDefChunk.DocumentPaths[baseDefDocumentID] = path
@@ -193,35 +240,120 @@ func patchData(ctx context.Context, base *correlation.GroupedBundleDataMaps, pat
 		}
 	}
 
-	for path, status := range fileStatus {
+	for path, status := range effectiveStatus {
 		if status == gitserver.Deleted {
 			log15.Warn(fmt.Sprintf("deleting path %v", path))
-			delete(base.Documents, path)
+			overlay.DeleteDocument(path)
 		}
 	}
 	for path := range pathsToCopy {
 		log15.Warn(fmt.Sprintf("copying document %v", path))
-		base.Documents[path] = patch.Documents[path]
+		overlay.SetDocument(path, patch.Documents[path])
 	}
 
-	return nil
+	return resultIDsAllocated, nil
 }
 
-func removeRefsIn(paths map[string]struct{}, meta lsifstore.MetaData, docs map[string]lsifstore.DocumentData, chunks map[int]lsifstore.ResultChunkData) {
-	deletedRefs := make(map[lsifstore.ID]struct{})
+// deadRangesFor is called once per path undergoing cleanup and must decide
+// which of doc's ranges are "dead" (their references should be stripped)
+// versus which survive untouched, e.g. because they fall inside an
+// unchanged hunk or were kept by a retainKeys directive.
+func deadRangesFor(directives map[string]DocumentDirective, retainMonikers map[string]map[lsifstore.ID]struct{}, hunksByPath map[string][]gitserver.Hunk) func(path string, doc lsifstore.DocumentData) map[lsifstore.ID]struct{} {
+	return func(path string, doc lsifstore.DocumentData) map[lsifstore.ID]struct{} {
+		dead := make(map[lsifstore.ID]struct{})
+
+		if directives[path] == DirectiveRetainKeys {
+			retain := retainMonikers[path]
+			for rngID, rng := range doc.Ranges {
+				if !rangeRetained(rng, retain) {
+					dead[rngID] = struct{}{}
+				}
+			}
+			return dead
+		}
+
+		// doc is the base revision's document, so its ranges are compared
+		// against the hunks' base-side spans (1-indexed) rather than the
+		// patch-side spans translateThroughUnchangedHunk checks.
+		hunks := hunksByPath[path]
+		for rngID, rng := range doc.Ranges {
+			startLine, endLine := rng.StartLine+1, rng.EndLine+1
+			unchanged := false
+			for _, h := range hunks {
+				if startLine >= h.BaseStartLine && endLine <= h.BaseEndLine {
+					unchanged = true
+					break
+				}
+			}
+			if !unchanged {
+				dead[rngID] = struct{}{}
+			}
+		}
+		return dead
+	}
+}
+
+// pruneRetainedDocuments applies DirectiveRetainKeys directives by staging,
+// for each such path, a document containing only the ranges whose
+// MonikerIDs intersect the path's retention set. It must run after
+// removeRefsIn so that removeRefsIn sees the pre-prune document and can
+// tell which ranges are being dropped.
+func pruneRetainedDocuments(overlay *correlation.OverlayBundle, directives map[string]DocumentDirective, retainMonikers map[string]map[lsifstore.ID]struct{}) {
+	for path, directive := range directives {
+		if directive != DirectiveRetainKeys {
+			continue
+		}
+
+		doc, exists := overlay.Document(path)
+		if !exists {
+			continue
+		}
+
+		retain := retainMonikers[path]
+		filtered := make(map[lsifstore.ID]lsifstore.RangeData, len(doc.Ranges))
+		for rngID, rng := range doc.Ranges {
+			if rangeRetained(rng, retain) {
+				filtered[rngID] = rng
+			}
+		}
+		overlay.SetDocument(path, lsifstore.DocumentData{Ranges: filtered})
+	}
+}
 
+// removeRefsIn strips references to paths (files that were deleted,
+// replaced, modified, or pruned by a retainKeys directive) out of base's
+// ref result chunks. deadRangesFor decides, per path, which ranges are
+// dead versus which survive verbatim; only dead ranges lose their
+// references. Every result chunk it touches is staged through overlay
+// rather than written in place.
+func removeRefsIn(paths map[string]struct{}, overlay *correlation.OverlayBundle, meta lsifstore.MetaData, deadRangesFor func(path string, doc lsifstore.DocumentData) map[lsifstore.ID]struct{}) {
+	docs := make(map[string]lsifstore.DocumentData, len(paths))
+	for path := range paths {
+		doc, _ := overlay.Document(path)
+		docs[path] = doc
+	}
+
+	deadRanges := make(map[string]map[lsifstore.ID]struct{}, len(paths))
+	for path := range paths {
+		deadRanges[path] = deadRangesFor(path, docs[path])
+	}
+
+	deletedRefs := make(map[lsifstore.ID]struct{})
 	for path := range paths {
 		doc := docs[path]
-		for _, rng := range doc.Ranges {
+		for rngID, rng := range doc.Ranges {
+			if _, isDead := deadRanges[path][rngID]; !isDead {
+				continue
+			}
 			if _, exists := deletedRefs[rng.ReferenceResultID]; exists {
 				continue
 			}
 
-			refs, refChunk := getDefRef(rng.ReferenceResultID, meta, chunks)
+			refs, refChunk := getDefRefOverlay(rng.ReferenceResultID, meta, overlay)
 			var filteredRefs []lsifstore.DocumentIDRangeID
 			for _, ref := range refs {
 				refPath := refChunk.DocumentPaths[ref.DocumentID]
-				if _, exists := paths[refPath]; !exists {
+				if _, isDeadRef := deadRanges[refPath][ref.RangeID]; !isDeadRef {
 					filteredRefs = append(filteredRefs, ref)
 				}
 			}
@@ -231,39 +363,90 @@ func removeRefsIn(paths map[string]struct{}, meta lsifstore.MetaData, docs map[s
 	}
 }
 
-var unequalUnmodifiedPathsErr = errors.New("The ranges of unmodified path in LSIF patch do not match ranges of the same path in the base LSIF dump.")
-
-func unifyRangeIDs(updateToDocs map[string]lsifstore.DocumentData, toUpdateMeta lsifstore.MetaData, toUpdateDocs map[string]lsifstore.DocumentData, toUpdateChunks map[int]lsifstore.ResultChunkData, fileStatus map[string]gitserver.Status) error {
+// unifyRangeIDs rewrites the range IDs of toUpdateDocs so that ranges which
+// already exist in base (read through overlay) reuse the base's IDs rather
+// than being allocated fresh ones, then fixes up every def/ref result that
+// pointed at an old ID. A path is handled one of three ways:
+//
+//   - Unchanged, or anything at all when opts.ResultChunkStrategy is
+//     preserveIDs: ranges are paired with the base by content hash (see
+//     RangeContentHash) rather than by position, so indexer output that
+//     isn't byte-identical across runs — a different range count included
+//     — still pairs up wherever the content actually matches. Base ranges
+//     with no patch counterpart are dropped with a log warning instead of
+//     failing the whole patch.
+//   - Modified, with hunks available in hunksByPath: each range that falls
+//     entirely inside an unchanged hunk is paired with its base
+//     counterpart by position; everything else gets a new ID.
+//   - Anything else: every range gets a new ID, matching the
+//     pre-hunk-patching, pre-directive behavior.
+//
+// The returned map records, per path, which of the final range IDs were
+// reused from the base rather than freshly allocated, so callers can tell
+// which ranges are safe to keep their existing def/ref result IDs. This
+// function only ever rewrites patch's own documents/chunks in place; patch
+// is scratch input staged into the overlay afterward, so it doesn't need
+// copy-on-write treatment of its own.
+func unifyRangeIDs(overlay *correlation.OverlayBundle, toUpdateMeta lsifstore.MetaData, toUpdateDocs map[string]lsifstore.DocumentData, toUpdateChunks map[int]lsifstore.ResultChunkData, fileStatus map[string]gitserver.Status, hunksByPath map[string][]gitserver.Hunk, opts PatchOptions) (map[string]map[lsifstore.ID]struct{}, error) {
 	updatedRngIDs := make(map[lsifstore.ID]lsifstore.ID)
 	resultsToUpdate := make(map[lsifstore.ID]struct{})
+	reusedRanges := make(map[string]map[lsifstore.ID]struct{})
 
 	for path, toUpdateDoc := range toUpdateDocs {
 		pathUpdatedRngIDs := make(map[lsifstore.ID]lsifstore.ID)
-		if fileStatus[path] == gitserver.Unchanged {
-			updateToDoc := updateToDocs[path]
-
-			updateToRngIDs := sortedRangeIDs(updateToDoc.Ranges)
-			toUpdateRng := sortedRangeIDs(toUpdateDoc.Ranges)
-			if len(toUpdateRng) != len(updateToRngIDs) {
-				return unequalUnmodifiedPathsErr
+		pathReused := make(map[lsifstore.ID]struct{})
+
+		switch {
+		case fileStatus[path] == gitserver.Unchanged || opts.ResultChunkStrategy == ResultChunkStrategyPreserveIDs:
+			updateToDoc, _ := overlay.Document(path)
+			paired, dropped := pairRangesByContentHash(path, updateToDoc, toUpdateDoc, opts.Hover, opts.Monikers)
+			for _, droppedRngID := range dropped {
+				log15.Warn(fmt.Sprintf("dropping base range with no patch counterpart for %q", path), "rangeID", droppedRngID)
+			}
+			for toUpdateRngID, updateToRngID := range paired {
+				pathUpdatedRngIDs[toUpdateRngID] = updateToRngID
+				pathReused[updateToRngID] = struct{}{}
+			}
+			for toUpdateRngID := range toUpdateDoc.Ranges {
+				if _, ok := pathUpdatedRngIDs[toUpdateRngID]; ok {
+					continue
+				}
+				newRngID, err := newID()
+				if err != nil {
+					return nil, err
+				}
+				updatedRngIDs[toUpdateRngID] = newRngID
 			}
 
-			for idx, updateToRngID := range updateToRngIDs {
-				updateToRng := updateToDoc.Ranges[updateToRngID]
-				toUpdateRngID := toUpdateRng[idx]
-				toUpdateRng := toUpdateDoc.Ranges[toUpdateRngID]
+		case hunksByPath[path] != nil:
+			updateToDoc, _ := overlay.Document(path)
+			hunks := hunksByPath[path]
 
-				if lsifstore.CompareRanges(updateToRng, toUpdateRng) != 0 {
-					return unequalUnmodifiedPathsErr
+			for toUpdateRngID, toUpdateRng := range toUpdateDoc.Ranges {
+				translated, ok := translateThroughUnchangedHunk(toUpdateRng, hunks)
+				baseRngID, matched := lsifstore.ID(""), false
+				if ok {
+					baseRngID, matched = findMatchingRange(updateToDoc, translated)
 				}
 
-				pathUpdatedRngIDs[toUpdateRngID] = updateToRngID
+				if !matched {
+					newRngID, err := newID()
+					if err != nil {
+						return nil, err
+					}
+					updatedRngIDs[toUpdateRngID] = newRngID
+					continue
+				}
+
+				pathUpdatedRngIDs[toUpdateRngID] = baseRngID
+				pathReused[baseRngID] = struct{}{}
 			}
-		} else {
+
+		default:
 			for rngID := range toUpdateDoc.Ranges {
 				newRngID, err := newID()
 				if err != nil {
-					return err
+					return nil, err
 				}
 				updatedRngIDs[rngID] = newRngID
 			}
@@ -275,6 +458,15 @@ func unifyRangeIDs(updateToDocs map[string]lsifstore.DocumentData, toUpdateMeta
 			resultsToUpdate[rng.ReferenceResultID] = struct{}{}
 			resultsToUpdate[rng.DefinitionResultID] = struct{}{}
 			delete(toUpdateDoc.Ranges, oldID)
+			// A reused ID is still a rename as far as the def/ref chunk
+			// fixup below is concerned: any result that referenced oldID
+			// needs to follow it to newID, exactly like a freshly
+			// allocated ID would.
+			updatedRngIDs[oldID] = newID
+		}
+
+		if len(pathReused) > 0 {
+			reusedRanges[path] = pathReused
 		}
 	}
 
@@ -297,7 +489,7 @@ func unifyRangeIDs(updateToDocs map[string]lsifstore.DocumentData, toUpdateMeta
 		chunk.DocumentIDRangeIDs[resultID] = updated
 	}
 
-	return nil
+	return reusedRanges, nil
 }
 
 func sortedRangeIDs(ranges map[lsifstore.ID]lsifstore.RangeData) []lsifstore.ID {
@@ -320,10 +512,21 @@ func getDefRef(resultID lsifstore.ID, meta lsifstore.MetaData, resultChunks map[
 	return docRngIDs, chunk
 }
 
+// getDefRefOverlay is getDefRef's overlay-aware counterpart: it reads (and,
+// on first touch this transaction, stages a copy-on-write copy of) the
+// result chunk through overlay instead of a plain map, so that mutating
+// the returned chunk's maps never reaches base until Commit.
+func getDefRefOverlay(resultID lsifstore.ID, meta lsifstore.MetaData, overlay *correlation.OverlayBundle) ([]lsifstore.DocumentIDRangeID, lsifstore.ResultChunkData) {
+	chunkID := lsifstore.HashKey(resultID, meta.NumResultChunks)
+	chunk := overlay.StagedResultChunk(chunkID)
+	docRngIDs := chunk.DocumentIDRangeIDs[resultID]
+	return docRngIDs, chunk
+}
+
 func newID() (lsifstore.ID, error) {
 	uuid, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 	return lsifstore.ID(uuid.String()), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/precise-code-intel-worker/internal/correlation"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/gitserver"
+	"github.com/sourcegraph/sourcegraph/enterprise/internal/codeintel/stores/lsifstore"
+)
+
+// TestApplyPatchHunkBasedIDReuse drives ApplyPatch end-to-end for a
+// Modified file, using hunks gitserver.BlobDiffHunks actually produces for
+// a realistic edit (an insertion that leaves one function untouched and
+// shifts another one down by a line offset), and checks that the ranges
+// translateThroughUnchangedHunk/findMatchingRange pair up with the base
+// keep the base's DefinitionResultID/ReferenceResultID, while the range
+// with no unchanged-hunk counterpart at all gets a freshly allocated pair
+// instead.
+func TestApplyPatchHunkBasedIDReuse(t *testing.T) {
+	baseContent := "package foo\n\nfunc Unmoved() {}\n\nfunc Moved() {}\n\nfunc End() {}\n"
+	patchContent := "package foo\n\nfunc Unmoved() {}\n\nfunc NewHelper() {}\n\nfunc Moved() {}\n\nfunc End() {}\n"
+	hunks := gitserver.BlobDiffHunks(baseContent, patchContent)
+
+	base := &correlation.GroupedBundleDataMaps{
+		Meta: lsifstore.MetaData{NumResultChunks: 1},
+		Documents: map[string]lsifstore.DocumentData{
+			"f.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{
+				// "func Unmoved() {}", base line 3 (0-indexed 2); untouched
+				// by the patch's insertion.
+				"base-unmoved": {StartLine: 2, StartCharacter: 0, EndLine: 2, EndCharacter: 5, DefinitionResultID: "def-unmoved", ReferenceResultID: "ref-unmoved"},
+				// "func Moved() {}", base line 5 (0-indexed 4); shifted down
+				// two lines in the patch by the inserted function above it.
+				"base-moved": {StartLine: 4, StartCharacter: 0, EndLine: 4, EndCharacter: 5, DefinitionResultID: "def-moved", ReferenceResultID: "ref-moved"},
+			}},
+		},
+		ResultChunks: map[int]lsifstore.ResultChunkData{
+			0: {
+				DocumentPaths: map[lsifstore.ID]string{"base-doc": "f.go"},
+				DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{
+					"def-unmoved": {{DocumentID: "base-doc", RangeID: "base-unmoved"}},
+					"ref-unmoved": {{DocumentID: "base-doc", RangeID: "base-unmoved"}},
+					"def-moved":   {{DocumentID: "base-doc", RangeID: "base-moved"}},
+					"ref-moved":   {{DocumentID: "base-doc", RangeID: "base-moved"}},
+				},
+			},
+		},
+	}
+
+	patch := &correlation.GroupedBundleDataMaps{
+		Meta: lsifstore.MetaData{NumResultChunks: 1},
+		Documents: map[string]lsifstore.DocumentData{
+			"f.go": {Ranges: map[lsifstore.ID]lsifstore.RangeData{
+				// "func Unmoved() {}", patch line 3 (0-indexed 2): same line
+				// as base, inside the hunk covering the file's untouched head.
+				"patch-unmoved": {StartLine: 2, StartCharacter: 0, EndLine: 2, EndCharacter: 5, DefinitionResultID: "pdef-unmoved", ReferenceResultID: "pref-unmoved"},
+				// "func Moved() {}", patch line 7 (0-indexed 6): shifted down
+				// by the two inserted lines, inside the second unchanged hunk.
+				"patch-moved": {StartLine: 6, StartCharacter: 0, EndLine: 6, EndCharacter: 5, DefinitionResultID: "pdef-moved", ReferenceResultID: "pref-moved"},
+				// "func NewHelper() {}", patch line 5 (0-indexed 4): the
+				// inserted content itself, covered by no unchanged hunk.
+				"patch-new": {StartLine: 4, StartCharacter: 0, EndLine: 4, EndCharacter: 5, DefinitionResultID: "pdef-new", ReferenceResultID: "pref-new"},
+			}},
+		},
+		ResultChunks: map[int]lsifstore.ResultChunkData{
+			0: {
+				DocumentPaths: map[lsifstore.ID]string{"patch-doc": "f.go"},
+				DocumentIDRangeIDs: map[lsifstore.ID][]lsifstore.DocumentIDRangeID{
+					"pdef-unmoved": {{DocumentID: "patch-doc", RangeID: "patch-unmoved"}},
+					"pref-unmoved": {{DocumentID: "patch-doc", RangeID: "patch-unmoved"}},
+					"pdef-moved":   {{DocumentID: "patch-doc", RangeID: "patch-moved"}},
+					"pref-moved":   {{DocumentID: "patch-doc", RangeID: "patch-moved"}},
+					"pdef-new":     {{DocumentID: "patch-doc", RangeID: "patch-new"}},
+					"pref-new":     {{DocumentID: "patch-doc", RangeID: "patch-new"}},
+				},
+			},
+		},
+	}
+
+	fileStatus := map[string]gitserver.Status{"f.go": gitserver.Modified}
+	hunksByPath := map[string][]gitserver.Hunk{"f.go": hunks}
+
+	if _, err := ApplyPatch(context.Background(), base, patch, []string{"f.go"}, fileStatus, hunksByPath, PatchOptions{}); err != nil {
+		t.Fatalf("ApplyPatch returned an unexpected error: %v", err)
+	}
+
+	merged := base.Documents["f.go"]
+
+	// A hunk-matched range is keyed by its base range ID in the merged
+	// document (mirroring how a full-file Unchanged pairing behaves),
+	// not by the patch-side ID it arrived under.
+	unmoved, ok := merged.Ranges["base-unmoved"]
+	if !ok {
+		t.Fatal("expected patch-unmoved to be paired with base-unmoved's range ID")
+	}
+	if unmoved.DefinitionResultID != "def-unmoved" || unmoved.ReferenceResultID != "ref-unmoved" {
+		t.Fatalf("expected patch-unmoved to reuse base-unmoved's result IDs, got def=%v ref=%v", unmoved.DefinitionResultID, unmoved.ReferenceResultID)
+	}
+
+	moved, ok := merged.Ranges["base-moved"]
+	if !ok {
+		t.Fatal("expected patch-moved to be paired with base-moved's range ID across the hunk's line offset")
+	}
+	if moved.DefinitionResultID != "def-moved" || moved.ReferenceResultID != "ref-moved" {
+		t.Fatalf("expected patch-moved to reuse base-moved's result IDs across the hunk's line offset, got def=%v ref=%v", moved.DefinitionResultID, moved.ReferenceResultID)
+	}
+
+	newRng, ok := merged.Ranges["patch-new"]
+	if !ok {
+		t.Fatal("expected patch-new to survive the merge under its patch range ID")
+	}
+	if newRng.DefinitionResultID == "pdef-new" || newRng.ReferenceResultID == "pref-new" {
+		t.Fatal("expected patch-new, which no hunk covers, to get freshly allocated result IDs rather than keep its patch-side ones")
+	}
+	if newRng.DefinitionResultID == "def-unmoved" || newRng.DefinitionResultID == "def-moved" {
+		t.Fatal("expected patch-new not to be mistakenly paired with an unrelated base range")
+	}
+}
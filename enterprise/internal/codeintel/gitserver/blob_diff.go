@@ -0,0 +1,67 @@
+package gitserver
+
+import (
+	"strings"
+
+	diffmatchpatch "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Hunk describes a contiguous span of lines that is byte-for-byte identical
+// between the base and patch revisions of a file. Line numbers are
+// 1-indexed and inclusive on both ends, matching git's own hunk notation.
+type Hunk struct {
+	BaseStartLine, BaseEndLine   int
+	PatchStartLine, PatchEndLine int
+}
+
+// BlobDiffHunks computes the unchanged hunks between the base and patch
+// contents of a single file, aligned on whole lines. Callers use the
+// returned hunks to translate line/character positions that fall inside an
+// unchanged span from the base revision onto the patch revision (or vice
+// versa) without having to re-resolve them against the new blob.
+func BlobDiffHunks(baseContent, patchContent string) []Hunk {
+	dmp := diffmatchpatch.New()
+	baseLines, patchLines, lineArray := dmp.DiffLinesToChars(baseContent, patchContent)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(baseLines, patchLines, false), lineArray)
+
+	var hunks []Hunk
+	baseLine, patchLine := 1, 1
+	for _, d := range diffs {
+		n := lineCount(d.Text)
+
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			if n > 0 {
+				hunks = append(hunks, Hunk{
+					BaseStartLine:  baseLine,
+					BaseEndLine:    baseLine + n - 1,
+					PatchStartLine: patchLine,
+					PatchEndLine:   patchLine + n - 1,
+				})
+			}
+			baseLine += n
+			patchLine += n
+		case diffmatchpatch.DiffDelete:
+			baseLine += n
+		case diffmatchpatch.DiffInsert:
+			patchLine += n
+		}
+	}
+
+	return hunks
+}
+
+// lineCount returns the number of lines represented by a diff segment's
+// text, counting a trailing partial line (no terminating newline) as one.
+func lineCount(text string) int {
+	if text == "" {
+		return 0
+	}
+
+	n := strings.Count(text, "\n")
+	if !strings.HasSuffix(text, "\n") {
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,58 @@
+package gitserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlobDiffHunks(t *testing.T) {
+	testCases := []struct {
+		name    string
+		base    string
+		patch   string
+		wantMin int // lower bound on number of unchanged hunks found
+	}{
+		{
+			name:    "append-only edit",
+			base:    "a\nb\nc\n",
+			patch:   "a\nb\nc\nd\n",
+			wantMin: 1,
+		},
+		{
+			name:    "edit in the middle of a file",
+			base:    "a\nb\nc\nd\ne\n",
+			patch:   "a\nb\nX\nd\ne\n",
+			wantMin: 2,
+		},
+		{
+			name:    "edit that moves an unchanged function by a line offset",
+			base:    "a\nfunc foo() {}\nc\n",
+			patch:   "a\nnewline\nfunc foo() {}\nc\n",
+			wantMin: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hunks := BlobDiffHunks(tc.base, tc.patch)
+			if len(hunks) < tc.wantMin {
+				t.Fatalf("expected at least %d unchanged hunks, got %d (%+v)", tc.wantMin, len(hunks), hunks)
+			}
+
+			baseLines := strings.Split(strings.TrimSuffix(tc.base, "\n"), "\n")
+			patchLines := strings.Split(strings.TrimSuffix(tc.patch, "\n"), "\n")
+			for _, h := range hunks {
+				if h.BaseEndLine-h.BaseStartLine != h.PatchEndLine-h.PatchStartLine {
+					t.Fatalf("hunk %+v does not span equal-length spans", h)
+				}
+				for i := 0; i <= h.BaseEndLine-h.BaseStartLine; i++ {
+					baseLine := baseLines[h.BaseStartLine-1+i]
+					patchLine := patchLines[h.PatchStartLine-1+i]
+					if baseLine != patchLine {
+						t.Fatalf("hunk %+v claims unchanged but base line %q != patch line %q", h, baseLine, patchLine)
+					}
+				}
+			}
+		})
+	}
+}
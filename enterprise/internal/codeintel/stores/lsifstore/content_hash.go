@@ -0,0 +1,34 @@
+package lsifstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// RangeContentHash derives a stable identity for a range from its shape and
+// the symbol data attached to it, rather than from its position in an
+// arbitrarily-ordered map. Two ranges from different indexer runs that hash
+// identically are considered the same range for the purposes of patch
+// merging, even if the indexer emitted them in a different order or
+// assigned them unrelated IDs.
+func RangeContentHash(r RangeData, hover string, monikers []MonikerData) ID {
+	sorted := make([]MonikerData, len(monikers))
+	copy(sorted, monikers)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Scheme != sorted[j].Scheme {
+			return sorted[i].Scheme < sorted[j].Scheme
+		}
+		return sorted[i].Identifier < sorted[j].Identifier
+	})
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:%d:%d\n", r.StartLine, r.StartCharacter, r.EndLine, r.EndCharacter)
+	h.Write([]byte(hover))
+	for _, m := range sorted {
+		fmt.Fprintf(h, "\n%s:%s", m.Scheme, m.Identifier)
+	}
+
+	return ID(hex.EncodeToString(h.Sum(nil)))
+}
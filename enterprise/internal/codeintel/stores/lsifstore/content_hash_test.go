@@ -0,0 +1,29 @@
+package lsifstore
+
+import "testing"
+
+func TestRangeContentHash(t *testing.T) {
+	rng := RangeData{StartLine: 1, StartCharacter: 2, EndLine: 1, EndCharacter: 10}
+	monikers := []MonikerData{{Scheme: "gomod", Identifier: "b"}, {Scheme: "gomod", Identifier: "a"}}
+
+	hash := RangeContentHash(rng, "hover text", monikers)
+	if hash == "" {
+		t.Fatal("expected a non-empty hash")
+	}
+
+	// Order of the moniker slice shouldn't matter.
+	reordered := []MonikerData{monikers[1], monikers[0]}
+	if got := RangeContentHash(rng, "hover text", reordered); got != hash {
+		t.Fatalf("expected hash to be independent of moniker order, got %q and %q", hash, got)
+	}
+
+	if got := RangeContentHash(rng, "different hover text", monikers); got == hash {
+		t.Fatal("expected hash to change when hover text changes")
+	}
+
+	movedRng := rng
+	movedRng.StartLine++
+	if got := RangeContentHash(movedRng, "hover text", monikers); got == hash {
+		t.Fatal("expected hash to change when the range position changes")
+	}
+}